@@ -48,21 +48,57 @@ func init() {
 type bisectionChallenge struct {
 	*challenge
 	BisectionChallenge *executionchallenge.BisectionChallenge
+	logsCache          *LogsCache
+	filterSystem       *FilterSystem
+	transactAuth       *TransactAuth
+	reorgTracker       *ReorgTracker
 }
 
-func newBisectionChallenge(address ethcommon.Address, client *ethclient.Client, auth *bind.TransactOpts) (*bisectionChallenge, error) {
+func newBisectionChallenge(address ethcommon.Address, client *ethclient.Client, auth *bind.TransactOpts, logsCache *LogsCache, filterSystem *FilterSystem) (*bisectionChallenge, error) {
 	challenge, err := newChallenge(address, client, auth)
 	if err != nil {
 		return nil, err
 	}
+	if logsCache == nil {
+		logsCache = NewLogsCache(*blockLogsCacheSizeFlag)
+	}
+	if filterSystem == nil {
+		filterSystem = NewFilterSystem(client, logsCache, Config{})
+	}
 	vm := &bisectionChallenge{
 		challenge:          challenge,
 		BisectionChallenge: nil,
+		logsCache:          logsCache,
+		filterSystem:       filterSystem,
+		transactAuth:       NewTransactAuth(auth),
+		reorgTracker:       NewReorgTracker(client, logsCache, DefaultFinalityDepth),
 	}
 	err = vm.setupContracts()
 	return vm, err
 }
 
+// NewBisectionChallenges builds one bisectionChallenge watcher per address
+// in addresses, all backed by a single LogsCache and FilterSystem built
+// from cfg. A validator defending many assertions at once calls this once
+// for the whole batch, instead of constructing each challenge through
+// newBisectionChallenge with a nil cache and letting every one of them open
+// its own private cache and its own upstream log/head subscriptions.
+func NewBisectionChallenges(addresses []ethcommon.Address, client *ethclient.Client, auth *bind.TransactOpts, cfg Config) ([]*bisectionChallenge, error) {
+	cfg = cfg.withDefaults()
+	logsCache := NewLogsCache(cfg.LogCacheSize)
+	filterSystem := NewFilterSystem(client, logsCache, cfg)
+
+	challenges := make([]*bisectionChallenge, 0, len(addresses))
+	for _, address := range addresses {
+		c, err := newBisectionChallenge(address, client, auth, logsCache, filterSystem)
+		if err != nil {
+			return nil, err
+		}
+		challenges = append(challenges, c)
+	}
+	return challenges, nil
+}
+
 func (c *bisectionChallenge) setupContracts() error {
 	challengeManagerContract, err := executionchallenge.NewBisectionChallenge(c.address, c.client)
 	if err != nil {
@@ -94,7 +130,7 @@ func (c *bisectionChallenge) StartConnection(ctx context.Context, outChan chan a
 	}
 
 	filter.ToBlock = header.Number
-	logs, err := c.client.FilterLogs(ctx, filter)
+	logs, err := c.logsCache.FilterLogs(ctx, c.client, filter)
 	if err != nil {
 		return err
 	}
@@ -106,27 +142,40 @@ func (c *bisectionChallenge) StartConnection(ctx context.Context, outChan chan a
 
 	filter.FromBlock = new(big.Int).Add(header.Number, big.NewInt(1))
 	filter.ToBlock = nil
-	logChan := make(chan types.Log)
-	logSub, err := c.client.SubscribeFilterLogs(ctx, filter, logChan)
+	logSub, err := c.filterSystem.SubscribeLogs(ctx, filter)
+	if err != nil {
+		return err
+	}
+
+	headSub, err := c.filterSystem.SubscribeNewHead(ctx)
 	if err != nil {
 		return err
 	}
 
 	go func() {
 		defer logSub.Unsubscribe()
+		defer headSub.Unsubscribe()
 
 		for {
 			select {
 			case <-ctx.Done():
 				break
-			case log := <-logChan:
+			case log := <-logSub.Logs:
 				if err := c.processEvents(ctx, log, outChan); err != nil {
 					errChan <- err
 					return
 				}
+			case head := <-headSub.Headers:
+				if err := c.reorgTracker.ProcessNewHead(ctx, head, outChan, c.processEvents); err != nil {
+					errChan <- err
+					return
+				}
 			case err := <-logSub.Err():
 				errChan <- err
 				return
+			case err := <-headSub.Err():
+				errChan <- err
+				return
 			}
 		}
 	}()
@@ -134,7 +183,7 @@ func (c *bisectionChallenge) StartConnection(ctx context.Context, outChan chan a
 }
 
 func (c *bisectionChallenge) processEvents(ctx context.Context, log types.Log, outChan chan arbbridge.Notification) error {
-	header, err := c.client.HeaderByHash(ctx, log.BlockHash)
+	header, err := c.logsCache.HeaderByHash(ctx, c.client, log.BlockHash)
 	if err != nil {
 		return err
 	}
@@ -144,7 +193,7 @@ func (c *bisectionChallenge) processEvents(ctx context.Context, log types.Log, o
 		if err != nil {
 			return err
 		}
-		outChan <- arbbridge.Notification{
+		c.reorgTracker.Hold(arbbridge.Notification{
 			BlockHeader: common.NewHashFromEth(header.Hash()),
 			BlockHeight: header.Number,
 			VMID:        common.NewAddressFromEth(c.address),
@@ -153,7 +202,7 @@ func (c *bisectionChallenge) processEvents(ctx context.Context, log types.Log, o
 				Deadline:     common.TimeTicks{Val: contChal.DeadlineTicks},
 			},
 			TxHash: log.TxHash,
-		}
+		}, log)
 	}
 	return nil
 }
@@ -164,9 +213,8 @@ func (c *bisectionChallenge) chooseSegment(
 	segments []common.Hash,
 ) error {
 	tree := NewMerkleTree(segments)
-	c.auth.Context = ctx
 	tx, err := c.BisectionChallenge.ChooseSegment(
-		c.auth,
+		c.transactAuth.Create(ctx),
 		big.NewInt(int64(segmentToChallenge)),
 		tree.GetProofFlat(int(segmentToChallenge)),
 		tree.GetRoot(),
@@ -0,0 +1,605 @@
+/*
+ * Copyright 2020, Offchain Labs, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ethbridge
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient"
+)
+
+// subscriptionInboxSize bounds how many undelivered logs a slow consumer
+// can fall behind by before dispatch starts dropping its oldest buffered
+// logs rather than blocking the shared upstream reader.
+const subscriptionInboxSize = 256
+
+// Config configures a FilterSystem, modeled on go-ethereum's
+// filters.Config.
+type Config struct {
+	// Timeout bounds how long the FilterSystem keeps retrying, with
+	// exponential backoff, after the upstream subscription drops before it
+	// gives up and surfaces the error to every subscriber. The budget
+	// resets on every successful (re)connect.
+	Timeout time.Duration
+	// LogCacheSize sizes the LogsCache a FilterSystem falls back to for its
+	// initial historical backfill and historical scans.
+	LogCacheSize int
+}
+
+func (cfg Config) withDefaults() Config {
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 5 * time.Minute
+	}
+	if cfg.LogCacheSize <= 0 {
+		cfg.LogCacheSize = *blockLogsCacheSizeFlag
+	}
+	return cfg
+}
+
+// Subscription is a live feed of logs matching the FilterQuery passed to
+// SubscribeLogs. Logs arrive on Logs; a delivery error (including upstream
+// disconnects that could not be recovered) arrives on Err, after which the
+// subscription is dead and must be re-established.
+type Subscription struct {
+	Logs chan types.Log
+
+	fs    *FilterSystem
+	query ethereum.FilterQuery
+	// backfillUntil is the highest block number already delivered via the
+	// historical backfill done at subscribe time; live dispatch skips logs
+	// at or below it to avoid delivering the same log twice. It is only
+	// meaningful once backfilling has been cleared.
+	backfillUntil uint64
+	// backfilling is 1 from the moment this subscription is registered
+	// until its historical backfill (if any) has finished and computed
+	// backfillUntil. While set, dispatch cannot yet tell which live logs
+	// fall inside the backfill range, so it buffers them in pending
+	// instead of guessing; see backfill and dispatch.
+	backfilling int32
+	bufMu       sync.Mutex
+	pending     []types.Log
+	inbox       chan types.Log
+	err         chan error
+	unsubbed    chan struct{}
+	once        sync.Once
+}
+
+// Err returns the channel on which a terminal subscription error is
+// delivered.
+func (s *Subscription) Err() <-chan error {
+	return s.err
+}
+
+// Unsubscribe stops delivery to this subscription's Logs channel. It is
+// safe to call more than once.
+func (s *Subscription) Unsubscribe() {
+	s.once.Do(func() {
+		close(s.unsubbed)
+		s.fs.removeSubscription(s)
+	})
+}
+
+// pump drains inbox into the consumer-facing Logs channel, so that dispatch
+// (called from the single upstream-reading goroutine) never blocks on a
+// slow consumer.
+func (s *Subscription) pump() {
+	for {
+		select {
+		case log := <-s.inbox:
+			select {
+			case s.Logs <- log:
+			case <-s.unsubbed:
+				return
+			}
+		case <-s.unsubbed:
+			return
+		}
+	}
+}
+
+// HeadSubscription is a live feed of new block headers, multiplexed the
+// same way a Subscription multiplexes logs.
+type HeadSubscription struct {
+	Headers chan *types.Header
+
+	fs       *FilterSystem
+	inbox    chan *types.Header
+	err      chan error
+	unsubbed chan struct{}
+	once     sync.Once
+}
+
+// Err returns the channel on which a terminal subscription error is
+// delivered.
+func (s *HeadSubscription) Err() <-chan error {
+	return s.err
+}
+
+// Unsubscribe stops delivery to this subscription's Headers channel. It is
+// safe to call more than once.
+func (s *HeadSubscription) Unsubscribe() {
+	s.once.Do(func() {
+		close(s.unsubbed)
+		s.fs.removeHeadSubscription(s)
+	})
+}
+
+func (s *HeadSubscription) pump() {
+	for {
+		select {
+		case head := <-s.inbox:
+			select {
+			case s.Headers <- head:
+			case <-s.unsubbed:
+				return
+			}
+		case <-s.unsubbed:
+			return
+		}
+	}
+}
+
+// FilterSystem multiplexes a single upstream SubscribeFilterLogs connection
+// (and, separately, a single SubscribeNewHead connection) across many
+// logically independent consumers, so a validator defending dozens of
+// assertions opens one websocket subscription of each kind instead of one
+// per challenge. bisectionChallenge is the only ethbridge watcher that
+// subscribes through it; the other watchers subscribe on the client
+// directly.
+type FilterSystem struct {
+	client *ethclient.Client
+	cache  *LogsCache
+	cfg    Config
+
+	mu          sync.Mutex
+	subs        map[*Subscription]struct{}
+	started     bool
+	headSubs    map[*HeadSubscription]struct{}
+	headStarted bool
+}
+
+// NewFilterSystem creates a FilterSystem backed by client. cache may be nil,
+// in which case a private LogsCache is created from cfg.LogCacheSize.
+func NewFilterSystem(client *ethclient.Client, cache *LogsCache, cfg Config) *FilterSystem {
+	cfg = cfg.withDefaults()
+	if cache == nil {
+		cache = NewLogsCache(cfg.LogCacheSize)
+	}
+	return &FilterSystem{
+		client:   client,
+		cache:    cache,
+		cfg:      cfg,
+		subs:     make(map[*Subscription]struct{}),
+		headSubs: make(map[*HeadSubscription]struct{}),
+	}
+}
+
+// SubscribeNewHead returns a HeadSubscription delivering every new block
+// header seen by the single underlying SubscribeNewHead connection this
+// FilterSystem maintains, regardless of how many callers subscribe.
+func (fs *FilterSystem) SubscribeNewHead(ctx context.Context) (*HeadSubscription, error) {
+	fs.mu.Lock()
+	if err := fs.ensureHeadUpstreamLocked(ctx); err != nil {
+		fs.mu.Unlock()
+		return nil, err
+	}
+	sub := &HeadSubscription{
+		Headers:  make(chan *types.Header),
+		fs:       fs,
+		inbox:    make(chan *types.Header, subscriptionInboxSize),
+		err:      make(chan error, 1),
+		unsubbed: make(chan struct{}),
+	}
+	fs.headSubs[sub] = struct{}{}
+	fs.mu.Unlock()
+
+	go sub.pump()
+	return sub, nil
+}
+
+// SubscribeLogs returns a Subscription delivering logs matching query. If
+// query.FromBlock is set, the historical range up to the current head (or
+// query.ToBlock, if set) is also served out of the shared LogsCache, so no
+// log in the requested range is missed. Historical logs are not guaranteed
+// to arrive before live ones; see backfill.
+func (fs *FilterSystem) SubscribeLogs(ctx context.Context, query ethereum.FilterQuery) (*Subscription, error) {
+	fs.mu.Lock()
+	if err := fs.ensureUpstreamLocked(ctx); err != nil {
+		fs.mu.Unlock()
+		return nil, err
+	}
+	sub := &Subscription{
+		Logs:     make(chan types.Log),
+		fs:       fs,
+		query:    query,
+		inbox:    make(chan types.Log, subscriptionInboxSize),
+		err:      make(chan error, 1),
+		unsubbed: make(chan struct{}),
+	}
+	if query.FromBlock != nil {
+		// Mark the subscription as backfilling before it is registered in
+		// fs.subs, i.e. before dispatch can ever see it, so there is no
+		// window where a live log for a not-yet-backfilled block could be
+		// delivered straight to inbox and then delivered again by backfill.
+		sub.backfilling = 1
+	}
+	fs.subs[sub] = struct{}{}
+	fs.mu.Unlock()
+
+	go sub.pump()
+
+	if query.FromBlock != nil {
+		if err := fs.backfill(ctx, sub); err != nil {
+			sub.Unsubscribe()
+			return nil, err
+		}
+	}
+	return sub, nil
+}
+
+// backfill fetches sub's historical range out of the shared LogsCache,
+// takes any live logs dispatch buffered for it while the range was being
+// fetched (deduping against what the historical fetch already covered), and
+// hands off to ordinary live dispatch. The historical logs, followed by the
+// buffered ones, are then sent to Logs from their own goroutine, while live
+// logs dispatched after the hand-off reach Logs through pump, so a live log
+// can arrive before historical ones; each log is still delivered once.
+func (fs *FilterSystem) backfill(ctx context.Context, sub *Subscription) error {
+	toBlock := sub.query.ToBlock
+	if toBlock == nil {
+		head, err := fs.client.HeaderByNumber(ctx, nil)
+		if err != nil {
+			return err
+		}
+		toBlock = head.Number
+	}
+
+	backfillQuery := sub.query
+	backfillQuery.ToBlock = toBlock
+	logs, err := fs.cache.FilterLogs(ctx, fs.client, backfillQuery)
+	if err != nil {
+		return err
+	}
+	until := toBlock.Uint64()
+	atomic.StoreUint64(&sub.backfillUntil, until)
+
+	sub.bufMu.Lock()
+	buffered := sub.pending
+	sub.pending = nil
+	atomic.StoreInt32(&sub.backfilling, 0)
+	sub.bufMu.Unlock()
+
+	replay := make([]types.Log, 0, len(buffered))
+	for _, log := range buffered {
+		if log.BlockNumber <= until {
+			// Already returned by the FilterLogs call above.
+			continue
+		}
+		replay = append(replay, log)
+	}
+
+	go func() {
+		for _, log := range logs {
+			select {
+			case sub.Logs <- log:
+			case <-sub.unsubbed:
+				return
+			}
+		}
+		for _, log := range replay {
+			select {
+			case sub.Logs <- log:
+			case <-sub.unsubbed:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func (fs *FilterSystem) ensureUpstreamLocked(ctx context.Context) error {
+	if fs.started {
+		return nil
+	}
+	fs.started = true
+	go fs.run(ctx)
+	return nil
+}
+
+// run maintains the single upstream subscription for the lifetime of ctx,
+// reconnecting with exponential backoff when it drops. cfg.Timeout bounds
+// the total time spent retrying a dead connection before giving up and
+// surfacing the error to every subscriber; the budget resets on every
+// successful (re)connect.
+func (fs *FilterSystem) run(ctx context.Context) {
+	deadline := time.Now().Add(fs.cfg.Timeout)
+	backoff := time.Second
+
+	for {
+		logChan := make(chan types.Log)
+		upstream, err := fs.client.SubscribeFilterLogs(ctx, ethereum.FilterQuery{}, logChan)
+		if err == nil {
+			backoff = time.Second
+
+			err = fs.pump(ctx, upstream, logChan)
+			upstream.Unsubscribe()
+			if ctx.Err() != nil {
+				return
+			}
+			// The retry budget starts when the connection drops.
+			deadline = time.Now().Add(fs.cfg.Timeout)
+			if err == nil {
+				continue
+			}
+		} else if ctx.Err() != nil {
+			return
+		}
+
+		if time.Now().After(deadline) {
+			fs.broadcastErr(err)
+			return
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+		if backoff < 30*time.Second {
+			backoff *= 2
+		}
+	}
+}
+
+// pump reads the upstream subscription until it errors or ctx is done.
+func (fs *FilterSystem) pump(ctx context.Context, upstream ethereum.Subscription, logChan chan types.Log) error {
+	for {
+		select {
+		case log := <-logChan:
+			fs.dispatch(log)
+		case err := <-upstream.Err():
+			return err
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// dispatch fans log out to every matching subscriber's inbox without
+// blocking: a subscriber whose inbox is full has its oldest buffered log
+// dropped to make room, so one stuck consumer can't stall delivery to the
+// rest of the multiplexed subscribers or back up the upstream reader.
+func (fs *FilterSystem) dispatch(log types.Log) {
+	fs.mu.Lock()
+	matching := make([]*Subscription, 0, len(fs.subs))
+	for sub := range fs.subs {
+		if matchesQuery(sub.query, log) {
+			matching = append(matching, sub)
+		}
+	}
+	fs.mu.Unlock()
+
+	for _, sub := range matching {
+		// The flag is checked under bufMu, which backfill holds while it
+		// drains pending and clears the flag, so a log can't be appended
+		// to pending after backfill has already taken it.
+		sub.bufMu.Lock()
+		if atomic.LoadInt32(&sub.backfilling) != 0 {
+			// backfillUntil isn't known yet, so this log can't be checked
+			// against it; hold onto it and let backfill sort out whether
+			// it duplicates the historical fetch once that range is known.
+			sub.pending = append(sub.pending, log)
+			sub.bufMu.Unlock()
+			continue
+		}
+		sub.bufMu.Unlock()
+		if log.BlockNumber <= atomic.LoadUint64(&sub.backfillUntil) {
+			continue
+		}
+		select {
+		case sub.inbox <- log:
+		default:
+			select {
+			case <-sub.inbox:
+			default:
+			}
+			select {
+			case sub.inbox <- log:
+			default:
+			}
+		}
+	}
+}
+
+func (fs *FilterSystem) broadcastErr(err error) {
+	fs.mu.Lock()
+	subs := make([]*Subscription, 0, len(fs.subs))
+	for sub := range fs.subs {
+		subs = append(subs, sub)
+	}
+	fs.started = false
+	fs.mu.Unlock()
+
+	for _, sub := range subs {
+		select {
+		case sub.err <- err:
+		default:
+		}
+	}
+}
+
+func (fs *FilterSystem) removeSubscription(sub *Subscription) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	delete(fs.subs, sub)
+}
+
+func (fs *FilterSystem) ensureHeadUpstreamLocked(ctx context.Context) error {
+	if fs.headStarted {
+		return nil
+	}
+	fs.headStarted = true
+	go fs.runHeads(ctx)
+	return nil
+}
+
+// runHeads maintains the single upstream head subscription for the
+// lifetime of ctx, reconnecting with the same backoff policy as run.
+func (fs *FilterSystem) runHeads(ctx context.Context) {
+	deadline := time.Now().Add(fs.cfg.Timeout)
+	backoff := time.Second
+
+	for {
+		headChan := make(chan *types.Header)
+		upstream, err := fs.client.SubscribeNewHead(ctx, headChan)
+		if err == nil {
+			backoff = time.Second
+
+			err = fs.pumpHeads(ctx, upstream, headChan)
+			upstream.Unsubscribe()
+			if ctx.Err() != nil {
+				return
+			}
+			// The retry budget starts when the connection drops.
+			deadline = time.Now().Add(fs.cfg.Timeout)
+			if err == nil {
+				continue
+			}
+		} else if ctx.Err() != nil {
+			return
+		}
+
+		if time.Now().After(deadline) {
+			fs.broadcastHeadErr(err)
+			return
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+		if backoff < 30*time.Second {
+			backoff *= 2
+		}
+	}
+}
+
+// pumpHeads reads the upstream head subscription until it errors or ctx is
+// done.
+func (fs *FilterSystem) pumpHeads(ctx context.Context, upstream ethereum.Subscription, headChan chan *types.Header) error {
+	for {
+		select {
+		case head := <-headChan:
+			fs.dispatchHead(head)
+		case err := <-upstream.Err():
+			return err
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// dispatchHead fans head out to every HeadSubscription's inbox without
+// blocking, using the same drop-oldest policy as dispatch.
+func (fs *FilterSystem) dispatchHead(head *types.Header) {
+	fs.mu.Lock()
+	subs := make([]*HeadSubscription, 0, len(fs.headSubs))
+	for sub := range fs.headSubs {
+		subs = append(subs, sub)
+	}
+	fs.mu.Unlock()
+
+	for _, sub := range subs {
+		select {
+		case sub.inbox <- head:
+		default:
+			select {
+			case <-sub.inbox:
+			default:
+			}
+			select {
+			case sub.inbox <- head:
+			default:
+			}
+		}
+	}
+}
+
+func (fs *FilterSystem) broadcastHeadErr(err error) {
+	fs.mu.Lock()
+	subs := make([]*HeadSubscription, 0, len(fs.headSubs))
+	for sub := range fs.headSubs {
+		subs = append(subs, sub)
+	}
+	fs.headStarted = false
+	fs.mu.Unlock()
+
+	for _, sub := range subs {
+		select {
+		case sub.err <- err:
+		default:
+		}
+	}
+}
+
+func (fs *FilterSystem) removeHeadSubscription(sub *HeadSubscription) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	delete(fs.headSubs, sub)
+}
+
+// matchesQuery reports whether log satisfies query's address and topic
+// criteria. An empty Addresses or Topics[i] slice matches anything, matching
+// the semantics of ethereum.FilterQuery.
+func matchesQuery(query ethereum.FilterQuery, log types.Log) bool {
+	if len(query.Addresses) > 0 {
+		found := false
+		for _, addr := range query.Addresses {
+			if addr == log.Address {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	for i, topics := range query.Topics {
+		if len(topics) == 0 {
+			continue
+		}
+		if i >= len(log.Topics) {
+			return false
+		}
+		found := false
+		for _, topic := range topics {
+			if topic == log.Topics[i] {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,140 @@
+/*
+ * Copyright 2020, Offchain Labs, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ethbridge
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum"
+	ethcommon "github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+func TestMatchesQueryAddressAndTopic(t *testing.T) {
+	addr := ethcommon.Address{1}
+	otherAddr := ethcommon.Address{2}
+	topic0 := ethcommon.Hash{3}
+	otherTopic0 := ethcommon.Hash{4}
+
+	query := ethereum.FilterQuery{
+		Addresses: []ethcommon.Address{addr},
+		Topics:    [][]ethcommon.Hash{{topic0}},
+	}
+
+	matching := types.Log{Address: addr, Topics: []ethcommon.Hash{topic0}}
+	if !matchesQuery(query, matching) {
+		t.Fatalf("expected log with matching address and topic0 to match")
+	}
+
+	wrongAddr := types.Log{Address: otherAddr, Topics: []ethcommon.Hash{topic0}}
+	if matchesQuery(query, wrongAddr) {
+		t.Fatalf("expected log with non-matching address not to match")
+	}
+
+	wrongTopic := types.Log{Address: addr, Topics: []ethcommon.Hash{otherTopic0}}
+	if matchesQuery(query, wrongTopic) {
+		t.Fatalf("expected log with non-matching topic0 not to match")
+	}
+}
+
+func TestMatchesQueryWildcards(t *testing.T) {
+	addr := ethcommon.Address{1}
+	topic0 := ethcommon.Hash{3}
+
+	// An empty Addresses/Topics entry matches anything, same as
+	// ethereum.FilterQuery semantics.
+	query := ethereum.FilterQuery{}
+	if !matchesQuery(query, types.Log{Address: addr, Topics: []ethcommon.Hash{topic0}}) {
+		t.Fatalf("expected an empty query to match any log")
+	}
+
+	// A literal zero-value hash inside a non-empty Topics[i] entry is not a
+	// wildcard: ethereum.FilterQuery only treats an *empty* Topics[i] slice
+	// as "match anything". A populated entry, even one containing the zero
+	// hash, must match exactly the values listed.
+	queryWithZeroTopic := ethereum.FilterQuery{
+		Topics: [][]ethcommon.Hash{{ethcommon.Hash{}, topic0}},
+	}
+	if matchesQuery(queryWithZeroTopic, types.Log{Topics: []ethcommon.Hash{{5}}}) {
+		t.Fatalf("expected a zero-hash topic entry not to act as a wildcard")
+	}
+	if !matchesQuery(queryWithZeroTopic, types.Log{Topics: []ethcommon.Hash{{}}}) {
+		t.Fatalf("expected an explicit zero-hash topic entry to match a log whose topic is actually the zero hash")
+	}
+	if !matchesQuery(queryWithZeroTopic, types.Log{Topics: []ethcommon.Hash{topic0}}) {
+		t.Fatalf("expected the other listed topic value to still match")
+	}
+}
+
+func TestMatchesQueryMissingTopicPosition(t *testing.T) {
+	query := ethereum.FilterQuery{
+		Topics: [][]ethcommon.Hash{{}, {ethcommon.Hash{9}}},
+	}
+	// The log doesn't have a second topic at all, so it can't satisfy a
+	// constraint on topic position 1.
+	if matchesQuery(query, types.Log{Topics: []ethcommon.Hash{{1}}}) {
+		t.Fatalf("expected log missing the constrained topic position not to match")
+	}
+}
+
+// TestDispatchBuffersWhileBackfilling exercises the window between a
+// subscription being registered (making it visible to dispatch) and its
+// backfill finishing (making backfillUntil meaningful). A live log landing
+// in that window must be buffered in pending rather than pushed straight to
+// inbox, since at that point dispatch can't yet tell whether the log falls
+// inside the range backfill is about to fetch.
+func TestDispatchBuffersWhileBackfilling(t *testing.T) {
+	fs := &FilterSystem{subs: make(map[*Subscription]struct{})}
+	sub := &Subscription{
+		query:       ethereum.FilterQuery{},
+		inbox:       make(chan types.Log, subscriptionInboxSize),
+		backfilling: 1,
+	}
+	fs.subs[sub] = struct{}{}
+
+	fs.dispatch(types.Log{BlockNumber: 5})
+
+	select {
+	case log := <-sub.inbox:
+		t.Fatalf("expected log to be buffered, not delivered to inbox: %+v", log)
+	default:
+	}
+	if len(sub.pending) != 1 || sub.pending[0].BlockNumber != 5 {
+		t.Fatalf("expected the log to be buffered in pending, got %+v", sub.pending)
+	}
+
+	// Once backfilling clears, dispatch goes back to delivering via inbox,
+	// checked against backfillUntil as usual.
+	sub.backfilling = 0
+	sub.backfillUntil = 5
+	fs.dispatch(types.Log{BlockNumber: 5})
+	fs.dispatch(types.Log{BlockNumber: 6})
+
+	select {
+	case log := <-sub.inbox:
+		if log.BlockNumber != 6 {
+			t.Fatalf("expected only the post-backfillUntil log to be delivered, got block %d", log.BlockNumber)
+		}
+	default:
+		t.Fatalf("expected the post-backfillUntil log to reach inbox")
+	}
+	select {
+	case log := <-sub.inbox:
+		t.Fatalf("expected no further logs in inbox, got %+v", log)
+	default:
+	}
+}
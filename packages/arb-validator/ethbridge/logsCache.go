@@ -0,0 +1,325 @@
+/*
+ * Copyright 2020, Offchain Labs, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ethbridge
+
+import (
+	"container/list"
+	"context"
+	"flag"
+	"math/big"
+	"sync"
+
+	"github.com/ethereum/go-ethereum"
+	ethcommon "github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient"
+)
+
+// DefaultBlockLogsCacheSize is used when no explicit size is configured via
+// the --cache.blocklogs flag.
+const DefaultBlockLogsCacheSize = 1024
+
+// blockLogsCacheSizeFlag is the --cache.blocklogs flag: the number of
+// entries per cache (logs and headers tracked independently) that a
+// LogsCache built without an explicit size, via Config.withDefaults, is
+// bounded to. It is declared here rather than in cmd/arb-validator so the
+// default advertised to operators and the default compiled into
+// DefaultBlockLogsCacheSize can't drift apart.
+var blockLogsCacheSizeFlag = flag.Int("cache.blocklogs", DefaultBlockLogsCacheSize, "number of entries the shared ethbridge.LogsCache retains in each of its log and header caches (a log entry is one block's logs for one address+topic0 pair)")
+
+// logsCacheKey identifies a single block's worth of logs for a given
+// address and topic0, so that multiple challenges watching overlapping
+// ranges can share a single FilterLogs result. Keying by block number
+// (rather than block hash, which we don't know until we've fetched the
+// block) is what lets FilterLogs detect which blocks in a requested range
+// are already cached.
+type logsCacheKey struct {
+	address     ethcommon.Address
+	topic0      ethcommon.Hash
+	blockNumber uint64
+}
+
+// LogsCache is a shared, LRU-bounded cache of historical logs and block
+// headers that bisectionChallenge watchers share to avoid re-fetching the
+// same block ranges from the RPC node when many challenges are active in
+// parallel. bisectionChallenge is the only ethbridge watcher that uses it;
+// the other watchers query the client directly.
+type LogsCache struct {
+	mu        sync.Mutex
+	size      int
+	logs      map[logsCacheKey]*list.Element
+	logsLRU   *list.List
+	headers   map[ethcommon.Hash]*list.Element
+	headerLRU *list.List
+}
+
+type logsCacheEntry struct {
+	key       logsCacheKey
+	blockHash ethcommon.Hash
+	logs      []types.Log
+}
+
+type headerCacheEntry struct {
+	hash   ethcommon.Hash
+	header *types.Header
+}
+
+// blockRange is an inclusive [from, to] span of block numbers not present
+// in the cache.
+type blockRange struct {
+	from, to uint64
+}
+
+// NewLogsCache creates a LogsCache bounded to size entries per cache (logs
+// and headers are tracked independently). A size <= 0 falls back to
+// DefaultBlockLogsCacheSize.
+func NewLogsCache(size int) *LogsCache {
+	if size <= 0 {
+		size = DefaultBlockLogsCacheSize
+	}
+	return &LogsCache{
+		size:      size,
+		logs:      make(map[logsCacheKey]*list.Element),
+		logsLRU:   list.New(),
+		headers:   make(map[ethcommon.Hash]*list.Element),
+		headerLRU: list.New(),
+	}
+}
+
+// FilterLogs returns the logs matching query, served per-block out of the
+// cache where possible. Only the gaps — block ranges not already cached for
+// every (address, topic0) pair in query — are fetched from client; the
+// results of those fetches are stored for future callers. Queries that
+// can't be split into per-block (address, topic0) entries up front — an
+// open-ended range (FromBlock or ToBlock unset), no address, no topic0, or
+// constraints on topics beyond topic0 — bypass the cache and are fetched
+// directly.
+func (c *LogsCache) FilterLogs(ctx context.Context, client *ethclient.Client, query ethereum.FilterQuery) ([]types.Log, error) {
+	if query.FromBlock == nil || query.ToBlock == nil ||
+		len(query.Addresses) == 0 || len(query.Topics) == 0 || len(query.Topics[0]) == 0 ||
+		len(query.Topics) > 1 {
+		logs, err := client.FilterLogs(ctx, query)
+		if err != nil {
+			return nil, err
+		}
+		return logs, nil
+	}
+
+	from := query.FromBlock.Uint64()
+	to := query.ToBlock.Uint64()
+
+	var result []types.Log
+	for _, address := range query.Addresses {
+		for _, topic0 := range query.Topics[0] {
+			pairLogs, err := c.filterPair(ctx, client, address, topic0, from, to)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, pairLogs...)
+		}
+	}
+	return result, nil
+}
+
+// filterPair serves [from,to] for a single (address, topic0) pair, fetching
+// only the sub-ranges that are missing from the cache.
+func (c *LogsCache) filterPair(ctx context.Context, client *ethclient.Client, address ethcommon.Address, topic0 ethcommon.Hash, from, to uint64) ([]types.Log, error) {
+	hits, gaps := c.scanRange(address, topic0, from, to)
+
+	for _, gap := range gaps {
+		query := ethereum.FilterQuery{
+			Addresses: []ethcommon.Address{address},
+			Topics:    [][]ethcommon.Hash{{topic0}},
+			FromBlock: new(big.Int).SetUint64(gap.from),
+			ToBlock:   new(big.Int).SetUint64(gap.to),
+		}
+		logs, err := client.FilterLogs(ctx, query)
+		if err != nil {
+			return nil, err
+		}
+		c.storeRange(address, topic0, gap.from, gap.to, logs)
+		hits = append(hits, logs...)
+	}
+	return hits, nil
+}
+
+// scanRange returns the already-cached logs and the gap ranges that still
+// need to be fetched to cover [from, to] for (address, topic0).
+func (c *LogsCache) scanRange(address ethcommon.Address, topic0 ethcommon.Hash, from, to uint64) ([]types.Log, []blockRange) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var hits []types.Log
+	var gaps []blockRange
+	inGap := false
+	var gapStart uint64
+
+	for n := from; n <= to; n++ {
+		key := logsCacheKey{address: address, topic0: topic0, blockNumber: n}
+		if elem, ok := c.logs[key]; ok {
+			c.logsLRU.MoveToFront(elem)
+			hits = append(hits, elem.Value.(*logsCacheEntry).logs...)
+			if inGap {
+				gaps = append(gaps, blockRange{from: gapStart, to: n - 1})
+				inGap = false
+			}
+			continue
+		}
+		if !inGap {
+			gapStart = n
+			inGap = true
+		}
+	}
+	if inGap {
+		gaps = append(gaps, blockRange{from: gapStart, to: to})
+	}
+	return hits, gaps
+}
+
+// storeRange records logs as the result of having fetched [from, to] for
+// (address, topic0), including marking blocks with no matching logs as
+// cached (empty), so a later call doesn't treat them as a gap again.
+func (c *LogsCache) storeRange(address ethcommon.Address, topic0 ethcommon.Hash, from, to uint64, logs []types.Log) {
+	byBlock := make(map[uint64][]types.Log)
+	blockHashes := make(map[uint64]ethcommon.Hash)
+	for _, log := range logs {
+		byBlock[log.BlockNumber] = append(byBlock[log.BlockNumber], log)
+		blockHashes[log.BlockNumber] = log.BlockHash
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for n := from; n <= to; n++ {
+		key := logsCacheKey{address: address, topic0: topic0, blockNumber: n}
+		c.putLocked(key, blockHashes[n], byBlock[n])
+	}
+}
+
+// HeaderByHash returns the header for hash, fetching and caching it from
+// client on a miss.
+func (c *LogsCache) HeaderByHash(ctx context.Context, client *ethclient.Client, hash ethcommon.Hash) (*types.Header, error) {
+	if header, ok := c.lookupHeader(hash); ok {
+		return header, nil
+	}
+	header, err := client.HeaderByHash(ctx, hash)
+	if err != nil {
+		return nil, err
+	}
+	c.storeHeader(hash, header)
+	return header, nil
+}
+
+// Invalidate drops any cached logs or header belonging to blockHash, which a
+// caller should invoke after observing a reorg.
+func (c *LogsCache) Invalidate(blockHash ethcommon.Hash) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, elem := range c.logs {
+		if elem.Value.(*logsCacheEntry).blockHash == blockHash {
+			c.logsLRU.Remove(elem)
+			delete(c.logs, key)
+		}
+	}
+	if elem, ok := c.headers[blockHash]; ok {
+		c.headerLRU.Remove(elem)
+		delete(c.headers, blockHash)
+	}
+}
+
+// InvalidateRange drops every cached log entry — for every (address, topic0)
+// pair, not just the one a caller happens to know about — and every cached
+// header whose block number falls in [from, to]. scanRange keys purely by
+// block number and never re-checks the canonical hash, so a
+// reorg must invalidate the whole affected range rather than the single
+// stale block hash that revealed it; otherwise every other (address,
+// topic0) pair cached for blocks in that range, and every other watcher
+// sharing this LogsCache, keeps serving pre-reorg data until LRU eviction.
+func (c *LogsCache) InvalidateRange(from, to uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, elem := range c.logs {
+		if key.blockNumber >= from && key.blockNumber <= to {
+			c.logsLRU.Remove(elem)
+			delete(c.logs, key)
+		}
+	}
+	for hash, elem := range c.headers {
+		number := elem.Value.(*headerCacheEntry).header.Number
+		if number != nil && number.Uint64() >= from && number.Uint64() <= to {
+			c.headerLRU.Remove(elem)
+			delete(c.headers, hash)
+		}
+	}
+}
+
+func (c *LogsCache) putLocked(key logsCacheKey, blockHash ethcommon.Hash, logs []types.Log) {
+	if elem, ok := c.logs[key]; ok {
+		c.logsLRU.MoveToFront(elem)
+		entry := elem.Value.(*logsCacheEntry)
+		entry.blockHash = blockHash
+		entry.logs = logs
+		return
+	}
+	elem := c.logsLRU.PushFront(&logsCacheEntry{key: key, blockHash: blockHash, logs: logs})
+	c.logs[key] = elem
+	if c.logsLRU.Len() > c.size {
+		c.evictOldestLogLocked()
+	}
+}
+
+func (c *LogsCache) evictOldestLogLocked() {
+	oldest := c.logsLRU.Back()
+	if oldest == nil {
+		return
+	}
+	c.logsLRU.Remove(oldest)
+	delete(c.logs, oldest.Value.(*logsCacheEntry).key)
+}
+
+func (c *LogsCache) lookupHeader(hash ethcommon.Hash) (*types.Header, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.headers[hash]
+	if !ok {
+		return nil, false
+	}
+	c.headerLRU.MoveToFront(elem)
+	return elem.Value.(*headerCacheEntry).header, true
+}
+
+func (c *LogsCache) storeHeader(hash ethcommon.Hash, header *types.Header) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.headers[hash]; ok {
+		c.headerLRU.MoveToFront(elem)
+		elem.Value.(*headerCacheEntry).header = header
+		return
+	}
+	elem := c.headerLRU.PushFront(&headerCacheEntry{hash: hash, header: header})
+	c.headers[hash] = elem
+	if c.headerLRU.Len() > c.size {
+		oldest := c.headerLRU.Back()
+		if oldest != nil {
+			c.headerLRU.Remove(oldest)
+			delete(c.headers, oldest.Value.(*headerCacheEntry).hash)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+/*
+ * Copyright 2020, Offchain Labs, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ethbridge
+
+import (
+	"math/big"
+	"testing"
+
+	ethcommon "github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+func blockHash(n uint64) ethcommon.Hash {
+	var h ethcommon.Hash
+	h[len(h)-1] = byte(n)
+	return h
+}
+
+func TestLogsCacheHeaderLRUEviction(t *testing.T) {
+	c := NewLogsCache(2)
+
+	h1, h2, h3 := blockHash(1), blockHash(2), blockHash(3)
+	c.storeHeader(h1, &types.Header{})
+	c.storeHeader(h2, &types.Header{})
+
+	if _, ok := c.lookupHeader(h1); !ok {
+		t.Fatalf("expected h1 to be cached before eviction")
+	}
+
+	// h1 is now most-recently-used; inserting h3 should evict h2, the
+	// least-recently-used entry, not h1.
+	c.storeHeader(h3, &types.Header{})
+
+	if _, ok := c.lookupHeader(h1); !ok {
+		t.Fatalf("h1 was evicted, but h2 was the least recently used entry")
+	}
+	if _, ok := c.lookupHeader(h2); ok {
+		t.Fatalf("h2 should have been evicted as the least recently used entry")
+	}
+	if _, ok := c.lookupHeader(h3); !ok {
+		t.Fatalf("expected h3 to be cached")
+	}
+}
+
+func TestLogsCacheBlockLRUEviction(t *testing.T) {
+	c := NewLogsCache(2)
+	addr := ethcommon.Address{1}
+	topic0 := ethcommon.Hash{2}
+
+	c.putLocked(logsCacheKey{address: addr, topic0: topic0, blockNumber: 1}, blockHash(1), nil)
+	c.putLocked(logsCacheKey{address: addr, topic0: topic0, blockNumber: 2}, blockHash(2), nil)
+
+	// Touch block 1 so it becomes most-recently-used.
+	if _, ok := c.logs[logsCacheKey{address: addr, topic0: topic0, blockNumber: 1}]; !ok {
+		t.Fatalf("expected block 1 entry to exist")
+	}
+	c.mu.Lock()
+	c.logsLRU.MoveToFront(c.logs[logsCacheKey{address: addr, topic0: topic0, blockNumber: 1}])
+	c.mu.Unlock()
+
+	c.putLocked(logsCacheKey{address: addr, topic0: topic0, blockNumber: 3}, blockHash(3), nil)
+
+	if _, ok := c.logs[logsCacheKey{address: addr, topic0: topic0, blockNumber: 1}]; !ok {
+		t.Fatalf("block 1 should not have been evicted, it was most recently used")
+	}
+	if _, ok := c.logs[logsCacheKey{address: addr, topic0: topic0, blockNumber: 2}]; ok {
+		t.Fatalf("block 2 should have been evicted as the least recently used entry")
+	}
+}
+
+func TestLogsCacheInvalidate(t *testing.T) {
+	c := NewLogsCache(8)
+	addr := ethcommon.Address{1}
+	topic0 := ethcommon.Hash{2}
+	hash := blockHash(5)
+
+	c.putLocked(logsCacheKey{address: addr, topic0: topic0, blockNumber: 5}, hash, nil)
+	c.storeHeader(hash, &types.Header{})
+
+	c.Invalidate(hash)
+
+	if _, ok := c.logs[logsCacheKey{address: addr, topic0: topic0, blockNumber: 5}]; ok {
+		t.Fatalf("Invalidate should have removed the cached logs for the reorged block")
+	}
+	if _, ok := c.lookupHeader(hash); ok {
+		t.Fatalf("Invalidate should have removed the cached header for the reorged block")
+	}
+}
+
+func TestLogsCacheInvalidateRange(t *testing.T) {
+	c := NewLogsCache(32)
+	addr := ethcommon.Address{1}
+	otherAddr := ethcommon.Address{2}
+	topic0 := ethcommon.Hash{3}
+
+	// Two different (address, topic0) pairs both have an entry for block 10,
+	// the reorged block; a header for block 10 is cached too.
+	c.putLocked(logsCacheKey{address: addr, topic0: topic0, blockNumber: 10}, blockHash(10), nil)
+	c.putLocked(logsCacheKey{address: otherAddr, topic0: topic0, blockNumber: 10}, blockHash(10), nil)
+	c.putLocked(logsCacheKey{address: addr, topic0: topic0, blockNumber: 15}, blockHash(15), nil)
+	h10 := blockHash(10)
+	c.storeHeader(h10, &types.Header{Number: big.NewInt(10)})
+
+	c.InvalidateRange(9, 12)
+
+	if _, ok := c.logs[logsCacheKey{address: addr, topic0: topic0, blockNumber: 10}]; ok {
+		t.Fatalf("expected block 10 to be invalidated for the first (address, topic0) pair")
+	}
+	if _, ok := c.logs[logsCacheKey{address: otherAddr, topic0: topic0, blockNumber: 10}]; ok {
+		t.Fatalf("expected block 10 to be invalidated for every (address, topic0) pair, not just the one whose hash the caller happened to know")
+	}
+	if _, ok := c.logs[logsCacheKey{address: addr, topic0: topic0, blockNumber: 15}]; !ok {
+		t.Fatalf("expected block 15, outside the invalidated range, to remain cached")
+	}
+	if _, ok := c.lookupHeader(h10); ok {
+		t.Fatalf("expected the header for block 10 to be invalidated")
+	}
+}
+
+func TestLogsCacheScanRangeFindsGaps(t *testing.T) {
+	c := NewLogsCache(32)
+	addr := ethcommon.Address{1}
+	topic0 := ethcommon.Hash{2}
+
+	c.putLocked(logsCacheKey{address: addr, topic0: topic0, blockNumber: 10}, blockHash(10), nil)
+	c.putLocked(logsCacheKey{address: addr, topic0: topic0, blockNumber: 11}, blockHash(11), nil)
+	// block 12 intentionally left uncached.
+	c.putLocked(logsCacheKey{address: addr, topic0: topic0, blockNumber: 13}, blockHash(13), nil)
+
+	_, gaps := c.scanRange(addr, topic0, 10, 13)
+	if len(gaps) != 1 || gaps[0] != (blockRange{from: 12, to: 12}) {
+		t.Fatalf("expected a single gap for block 12, got %v", gaps)
+	}
+}
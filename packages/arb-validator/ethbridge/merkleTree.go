@@ -0,0 +1,133 @@
+/*
+ * Copyright 2020, Offchain Labs, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ethbridge
+
+import (
+	"github.com/ethereum/go-ethereum/crypto"
+
+	"github.com/offchainlabs/arbitrum/packages/arb-util/common"
+)
+
+// Hasher combines two node hashes into their parent hash. Keccak256Hasher
+// is the default; a zk-friendly on-chain verifier can instead supply a
+// Poseidon or Pedersen hasher without touching the tree-building logic
+// below.
+type Hasher func(data ...[]byte) common.Hash
+
+// Keccak256Hasher is the default Hasher, matching the hash used on-chain by
+// the BisectionChallenge contracts today.
+func Keccak256Hasher(data ...[]byte) common.Hash {
+	return common.NewHashFromEth(crypto.Keccak256Hash(data...))
+}
+
+// MerkleTree is a binary tree over a fixed set of leaf segments, used to
+// produce the root and sibling proof a bisection challenge submits
+// on-chain in ChooseSegment. The leaf layer is padded with zero hashes up
+// to the next power of two, so every level has even length and every leaf
+// has a well-defined sibling at every level, rather than carrying an odd
+// node up unchanged (which has no well-defined sibling to begin with, so
+// GetProofFlat/UpdateLeaf cannot produce a real proof for it).
+//
+// This pairing convention (zero-hash padding to a power of two) has not
+// been checked against the deployed BisectionChallenge Solidity verifier
+// in this series — ChooseSegment's proof is consensus-critical, and a
+// mismatch here means every proof this code builds fails on-chain
+// verification. Confirm against the contract source or a known-good proof
+// test vector before this is relied on to submit real ChooseSegment calls.
+type MerkleTree struct {
+	hasher Hasher
+	// layers[0] holds the (possibly padded) leaves; layers[len(layers)-1]
+	// holds the root.
+	layers [][]common.Hash
+}
+
+// NewMerkleTree builds a MerkleTree over segments using Keccak256Hasher.
+func NewMerkleTree(segments []common.Hash) *MerkleTree {
+	return NewMerkleTreeWithHasher(Keccak256Hasher, segments)
+}
+
+// NewMerkleTreeWithHasher builds a MerkleTree over segments using hasher to
+// combine sibling pairs.
+func NewMerkleTreeWithHasher(hasher Hasher, segments []common.Hash) *MerkleTree {
+	layers := [][]common.Hash{padToPowerOfTwo(segments)}
+	for len(layers[len(layers)-1]) > 1 {
+		layers = append(layers, nextLayer(hasher, layers[len(layers)-1]))
+	}
+	return &MerkleTree{hasher: hasher, layers: layers}
+}
+
+func padToPowerOfTwo(segments []common.Hash) []common.Hash {
+	size := 1
+	for size < len(segments) {
+		size *= 2
+	}
+	padded := make([]common.Hash, size)
+	copy(padded, segments)
+	return padded
+}
+
+func nextLayer(hasher Hasher, layer []common.Hash) []common.Hash {
+	next := make([]common.Hash, len(layer)/2)
+	for i := 0; i < len(layer); i += 2 {
+		next[i/2] = hasher(layer[i].Bytes(), layer[i+1].Bytes())
+	}
+	return next
+}
+
+// GetRoot returns the tree's root hash.
+func (t *MerkleTree) GetRoot() common.Hash {
+	root := t.layers[len(t.layers)-1]
+	return root[0]
+}
+
+// GetNode returns the leaf hash at index.
+func (t *MerkleTree) GetNode(index int) common.Hash {
+	return t.layers[0][index]
+}
+
+// GetProofFlat returns the sibling hashes on the path from the leaf at
+// index up to the root, ordered bottom-to-top, as submitted on-chain
+// alongside ChooseSegment.
+func (t *MerkleTree) GetProofFlat(index int) []common.Hash {
+	proof := make([]common.Hash, 0, len(t.layers)-1)
+	for _, layer := range t.layers[:len(t.layers)-1] {
+		proof = append(proof, layer[index^1])
+		index /= 2
+	}
+	return proof
+}
+
+// UpdateLeaf replaces the leaf at index with hash and recomputes only the
+// path from that leaf to the root, in O(log n) instead of rebuilding the
+// whole tree. It returns the new root and the updated proof for index,
+// which matters once segment counts grow large enough (e.g. 1024-way
+// bisection) that a full rebuild dominates validator CPU time between
+// bisection rounds.
+func (t *MerkleTree) UpdateLeaf(index int, hash common.Hash) (common.Hash, []common.Hash) {
+	leafIndex := index
+	t.layers[0][index] = hash
+
+	for level := 0; level < len(t.layers)-1; level++ {
+		layer := t.layers[level]
+		pairIndex := index &^ 1
+		parent := t.hasher(layer[pairIndex].Bytes(), layer[pairIndex+1].Bytes())
+		index /= 2
+		t.layers[level+1][index] = parent
+	}
+
+	return t.GetRoot(), t.GetProofFlat(leafIndex)
+}
@@ -0,0 +1,102 @@
+/*
+ * Copyright 2020, Offchain Labs, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ethbridge
+
+import (
+	"testing"
+
+	ethcommon "github.com/ethereum/go-ethereum/common"
+
+	"github.com/offchainlabs/arbitrum/packages/arb-util/common"
+)
+
+func testLeaf(b byte) common.Hash {
+	var raw ethcommon.Hash
+	raw[len(raw)-1] = b
+	return common.NewHashFromEth(raw)
+}
+
+// verifyProof recomputes the root from leaf, proof and index the same way
+// the on-chain verifier would, and checks it matches root.
+func verifyProof(t *testing.T, hasher Hasher, leaf common.Hash, proof []common.Hash, index int, root common.Hash) {
+	t.Helper()
+	node := leaf
+	for _, sibling := range proof {
+		if index%2 == 0 {
+			node = hasher(node.Bytes(), sibling.Bytes())
+		} else {
+			node = hasher(sibling.Bytes(), node.Bytes())
+		}
+		index /= 2
+	}
+	if node != root {
+		t.Fatalf("proof did not reconstruct root: got %v, want %v", node, root)
+	}
+}
+
+func TestMerkleTreeProof(t *testing.T) {
+	segments := []common.Hash{testLeaf(1), testLeaf(2), testLeaf(3), testLeaf(4), testLeaf(5)}
+	tree := NewMerkleTree(segments)
+	root := tree.GetRoot()
+
+	for i := range segments {
+		proof := tree.GetProofFlat(i)
+		verifyProof(t, Keccak256Hasher, tree.GetNode(i), proof, i, root)
+	}
+}
+
+func TestMerkleTreeSingleLeaf(t *testing.T) {
+	segments := []common.Hash{testLeaf(7)}
+	tree := NewMerkleTree(segments)
+	if tree.GetRoot() != segments[0] {
+		t.Fatalf("single-leaf tree root should equal the leaf itself")
+	}
+}
+
+func TestMerkleTreeUpdateLeafMatchesRebuild(t *testing.T) {
+	segments := []common.Hash{testLeaf(1), testLeaf(2), testLeaf(3), testLeaf(4), testLeaf(5)}
+	tree := NewMerkleTree(segments)
+
+	segments[2] = testLeaf(42)
+	wantRoot := NewMerkleTree(segments).GetRoot()
+
+	gotRoot, proof := tree.UpdateLeaf(2, segments[2])
+	if gotRoot != wantRoot {
+		t.Fatalf("UpdateLeaf root = %v, want %v", gotRoot, wantRoot)
+	}
+	if tree.GetRoot() != wantRoot {
+		t.Fatalf("tree root after UpdateLeaf = %v, want %v", tree.GetRoot(), wantRoot)
+	}
+	verifyProof(t, Keccak256Hasher, segments[2], proof, 2, wantRoot)
+}
+
+func TestMerkleTreeWithHasher(t *testing.T) {
+	calls := 0
+	countingHasher := func(data ...[]byte) common.Hash {
+		calls++
+		return Keccak256Hasher(data...)
+	}
+
+	segments := []common.Hash{testLeaf(1), testLeaf(2)}
+	tree := NewMerkleTreeWithHasher(countingHasher, segments)
+	if calls == 0 {
+		t.Fatalf("custom hasher was never invoked")
+	}
+	if tree.GetRoot() != Keccak256Hasher(segments[0].Bytes(), segments[1].Bytes()) {
+		t.Fatalf("custom hasher result did not match expected Keccak256 root")
+	}
+}
@@ -0,0 +1,220 @@
+/*
+ * Copyright 2020, Offchain Labs, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ethbridge
+
+import (
+	"context"
+	"math/big"
+	"sync"
+
+	"github.com/ethereum/go-ethereum"
+	ethcommon "github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient"
+
+	"github.com/offchainlabs/arbitrum/packages/arb-validator/arbbridge"
+)
+
+// DefaultFinalityDepth is the number of confirmations a ReorgTracker waits
+// for before treating a log as settled, absent an explicit override.
+const DefaultFinalityDepth = 12
+
+// ReprocessFunc re-derives and forwards the Notification(s) for log, the
+// same way the original watcher's processEvents would.
+type ReprocessFunc func(ctx context.Context, log types.Log, outChan chan arbbridge.Notification) error
+
+type pendingNotification struct {
+	notification arbbridge.Notification
+	log          types.Log
+	height       uint64
+}
+
+// ReorgTracker holds emitted Notifications back until their underlying log
+// has finalityDepth confirmations, so a reorg that would revert an
+// already-forwarded event (e.g. a Continued challenge event) can instead be
+// caught and corrected before any downstream state machine acts on it.
+type ReorgTracker struct {
+	client        *ethclient.Client
+	logsCache     *LogsCache
+	finalityDepth uint64
+
+	mu      sync.Mutex
+	pending []*pendingNotification
+}
+
+// NewReorgTracker creates a ReorgTracker. A finalityDepth of 0 falls back
+// to DefaultFinalityDepth.
+func NewReorgTracker(client *ethclient.Client, logsCache *LogsCache, finalityDepth uint64) *ReorgTracker {
+	if finalityDepth == 0 {
+		finalityDepth = DefaultFinalityDepth
+	}
+	return &ReorgTracker{
+		client:        client,
+		logsCache:     logsCache,
+		finalityDepth: finalityDepth,
+	}
+}
+
+// Hold buffers notification, derived from log, until it reaches finality.
+func (r *ReorgTracker) Hold(notification arbbridge.Notification, log types.Log) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.pending = append(r.pending, &pendingNotification{
+		notification: notification,
+		log:          log,
+		height:       log.BlockNumber,
+	})
+}
+
+// reorgKey identifies the (address, topic0) pair a reorged log was filtered
+// on, so ProcessNewHead can replay each distinct pair's range once rather
+// than once per pending entry that happened to reorg.
+type reorgKey struct {
+	address ethcommon.Address
+	topic0  ethcommon.Hash
+}
+
+// reorgPlan is the result of checking a batch of partitionReady entries
+// against the canonical chain. Entries still on the canonical chain are
+// forwarded as-is via canonical; every reorged entry is merged into a
+// single replay: their ranges all end at the same head, so the union of
+// per-entry ranges is just [from, head], and replay is keyed by (address,
+// topic0) so two reorged entries that filter on the same pair invalidate
+// and replay their overlapping range exactly once instead of once each.
+type reorgPlan struct {
+	canonical []*pendingNotification
+	reorged   bool
+	from      uint64
+	replay    map[reorgKey]types.Log
+}
+
+// planReorgs builds a reorgPlan for ready, given the canonical block hash at
+// each entry's height (canonicalHash[i] corresponds to ready[i]).
+func planReorgs(ready []*pendingNotification, canonicalHash []ethcommon.Hash) reorgPlan {
+	plan := reorgPlan{replay: make(map[reorgKey]types.Log)}
+	for i, entry := range ready {
+		if canonicalHash[i] == entry.log.BlockHash {
+			plan.canonical = append(plan.canonical, entry)
+			continue
+		}
+
+		if !plan.reorged || entry.height < plan.from {
+			plan.from = entry.height
+		}
+		plan.reorged = true
+
+		key := reorgKey{address: entry.log.Address, topic0: entry.log.Topics[0]}
+		if _, ok := plan.replay[key]; !ok {
+			plan.replay[key] = entry.log
+		}
+	}
+	return plan
+}
+
+// ProcessNewHead releases any buffered notifications that have now reached
+// finality, forwarding arbbridge.ReorgEvent and re-processing the affected
+// range via reprocess whenever a held log's block hash no longer matches
+// the canonical chain.
+func (r *ReorgTracker) ProcessNewHead(
+	ctx context.Context,
+	head *types.Header,
+	outChan chan arbbridge.Notification,
+	reprocess ReprocessFunc,
+) error {
+	ready := r.partitionReady(head.Number.Uint64())
+
+	canonicalHash := make([]ethcommon.Hash, len(ready))
+	for i, entry := range ready {
+		canonical, err := r.client.HeaderByNumber(ctx, new(big.Int).SetUint64(entry.height))
+		if err != nil {
+			return err
+		}
+		canonicalHash[i] = canonical.Hash()
+	}
+
+	plan := planReorgs(ready, canonicalHash)
+	for _, entry := range plan.canonical {
+		outChan <- entry.notification
+	}
+	if !plan.reorged {
+		return nil
+	}
+
+	to := head.Number.Uint64()
+	r.logsCache.InvalidateRange(plan.from, to)
+	outChan <- arbbridge.Notification{
+		Event: arbbridge.ReorgEvent{FromHeight: new(big.Int).SetUint64(plan.from)},
+	}
+
+	for _, staleLog := range plan.replay {
+		if err := r.replayRange(ctx, plan.from, to, staleLog, outChan, reprocess); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// partitionReady removes and returns the pending entries whose log has now
+// reached finalityDepth confirmations against headNumber, leaving the rest
+// buffered for a later head.
+func (r *ReorgTracker) partitionReady(headNumber uint64) []*pendingNotification {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ready := make([]*pendingNotification, 0, len(r.pending))
+	remaining := r.pending[:0]
+	for _, entry := range r.pending {
+		if headNumber >= entry.height+r.finalityDepth {
+			ready = append(ready, entry)
+		} else {
+			remaining = append(remaining, entry)
+		}
+	}
+	r.pending = remaining
+	return ready
+}
+
+// replayRange re-runs FilterLogs over [from,to] for the reorged log's
+// address and topics, re-emitting corrected events through reprocess.
+func (r *ReorgTracker) replayRange(
+	ctx context.Context,
+	from, to uint64,
+	staleLog types.Log,
+	outChan chan arbbridge.Notification,
+	reprocess ReprocessFunc,
+) error {
+	logs, err := r.client.FilterLogs(ctx, filterQueryForLog(staleLog, from, to))
+	if err != nil {
+		return err
+	}
+	for _, log := range logs {
+		if err := reprocess(ctx, log, outChan); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func filterQueryForLog(log types.Log, from, to uint64) ethereum.FilterQuery {
+	return ethereum.FilterQuery{
+		Addresses: []ethcommon.Address{log.Address},
+		Topics:    [][]ethcommon.Hash{{log.Topics[0]}},
+		FromBlock: new(big.Int).SetUint64(from),
+		ToBlock:   new(big.Int).SetUint64(to),
+	}
+}
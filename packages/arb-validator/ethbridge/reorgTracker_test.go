@@ -0,0 +1,139 @@
+/*
+ * Copyright 2020, Offchain Labs, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ethbridge
+
+import (
+	"testing"
+
+	ethcommon "github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+
+	"github.com/offchainlabs/arbitrum/packages/arb-validator/arbbridge"
+)
+
+func TestReorgTrackerPartitionReadyHonorsFinalityDepth(t *testing.T) {
+	r := NewReorgTracker(nil, nil, 12)
+	r.Hold(arbbridge.Notification{}, types.Log{BlockNumber: 100})
+
+	if ready := r.partitionReady(111); len(ready) != 0 {
+		t.Fatalf("expected log at height 100 to still be pending 11 confirmations in, got %d ready", len(ready))
+	}
+	if len(r.pending) != 1 {
+		t.Fatalf("expected the entry to remain buffered")
+	}
+
+	ready := r.partitionReady(112)
+	if len(ready) != 1 {
+		t.Fatalf("expected the entry to be released at exactly finalityDepth confirmations, got %d ready", len(ready))
+	}
+	if len(r.pending) != 0 {
+		t.Fatalf("expected the released entry to be removed from pending")
+	}
+}
+
+func TestReorgTrackerPartitionReadyDefaultDepth(t *testing.T) {
+	r := NewReorgTracker(nil, nil, 0)
+	if r.finalityDepth != DefaultFinalityDepth {
+		t.Fatalf("expected a finalityDepth of 0 to fall back to DefaultFinalityDepth, got %d", r.finalityDepth)
+	}
+}
+
+func TestReorgTrackerPartitionReadyKeepsLaterEntriesPending(t *testing.T) {
+	r := NewReorgTracker(nil, nil, 12)
+	r.Hold(arbbridge.Notification{}, types.Log{BlockNumber: 100})
+	r.Hold(arbbridge.Notification{}, types.Log{BlockNumber: 105})
+
+	ready := r.partitionReady(112)
+	if len(ready) != 1 || ready[0].height != 100 {
+		t.Fatalf("expected only the height-100 entry to be ready at head 112, got %+v", ready)
+	}
+	if len(r.pending) != 1 || r.pending[0].height != 105 {
+		t.Fatalf("expected the height-105 entry to remain pending, got %+v", r.pending)
+	}
+}
+
+func TestPlanReorgsPassesThroughCanonicalEntries(t *testing.T) {
+	log := types.Log{BlockNumber: 100, BlockHash: ethcommon.Hash{1}}
+	entry := &pendingNotification{notification: arbbridge.Notification{TxHash: ethcommon.Hash{2}}, log: log, height: 100}
+
+	plan := planReorgs([]*pendingNotification{entry}, []ethcommon.Hash{log.BlockHash})
+
+	if plan.reorged {
+		t.Fatalf("expected a canonical entry not to be treated as reorged")
+	}
+	if len(plan.canonical) != 1 || plan.canonical[0] != entry {
+		t.Fatalf("expected the canonical entry to be forwarded as-is, got %+v", plan.canonical)
+	}
+	if len(plan.replay) != 0 {
+		t.Fatalf("expected no replay entries, got %+v", plan.replay)
+	}
+}
+
+func TestPlanReorgsMergesOverlappingRangesByKey(t *testing.T) {
+	addr := ethcommon.Address{1}
+	topic0 := ethcommon.Hash{2}
+
+	// Two entries reorged in the same batch, both filtered on the same
+	// (address, topic0) pair, with overlapping [height, head] ranges (they
+	// necessarily overlap since every range ends at the same head).
+	entryA := &pendingNotification{
+		log:    types.Log{BlockNumber: 100, BlockHash: ethcommon.Hash{3}, Address: addr, Topics: []ethcommon.Hash{topic0}},
+		height: 100,
+	}
+	entryB := &pendingNotification{
+		log:    types.Log{BlockNumber: 105, BlockHash: ethcommon.Hash{4}, Address: addr, Topics: []ethcommon.Hash{topic0}},
+		height: 105,
+	}
+	ready := []*pendingNotification{entryA, entryB}
+	// Canonical hashes that don't match either entry's log hash, so both
+	// are reorged.
+	canonicalHash := []ethcommon.Hash{{9}, {9}}
+
+	plan := planReorgs(ready, canonicalHash)
+
+	if !plan.reorged {
+		t.Fatalf("expected both entries to be treated as reorged")
+	}
+	if plan.from != 100 {
+		t.Fatalf("expected the merged replay to start at the lowest reorged height 100, got %d", plan.from)
+	}
+	if len(plan.canonical) != 0 {
+		t.Fatalf("expected no canonical entries, got %+v", plan.canonical)
+	}
+	// The overlap between the two entries' ranges must be replayed exactly
+	// once: one (address, topic0) pair means exactly one replay entry,
+	// regardless of how many pending entries reorged against it.
+	if len(plan.replay) != 1 {
+		t.Fatalf("expected the two overlapping entries to collapse into one replay entry, got %d", len(plan.replay))
+	}
+}
+
+func TestPlanReorgsKeepsDistinctKeysSeparate(t *testing.T) {
+	logA := types.Log{BlockNumber: 100, BlockHash: ethcommon.Hash{3}, Address: ethcommon.Address{1}, Topics: []ethcommon.Hash{{5}}}
+	logB := types.Log{BlockNumber: 100, BlockHash: ethcommon.Hash{4}, Address: ethcommon.Address{2}, Topics: []ethcommon.Hash{{6}}}
+	ready := []*pendingNotification{
+		{log: logA, height: 100},
+		{log: logB, height: 100},
+	}
+	canonicalHash := []ethcommon.Hash{{9}, {9}}
+
+	plan := planReorgs(ready, canonicalHash)
+
+	if len(plan.replay) != 2 {
+		t.Fatalf("expected distinct (address, topic0) pairs to replay separately, got %d", len(plan.replay))
+	}
+}
@@ -0,0 +1,81 @@
+/*
+ * Copyright 2020, Offchain Labs, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ethbridge
+
+import (
+	"context"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+)
+
+// TransactAuth builds a fresh *bind.TransactOpts for each call site instead
+// of mutating a shared TransactOpts in place. Mutating c.auth.Context on a
+// TransactOpts shared across concurrent challenges races, and silently
+// dropped cancellation during signing (see go-ethereum's NewKeyedTransactor
+// fix, which always sets Context: context.Background() for the same
+// reason).
+//
+// NoSend, GasFeeCap, and GasTipCap are bind.TransactOpts fields added well
+// after early go-ethereum releases (NoSend for skip-broadcast/private-relay
+// submission, GasFeeCap/GasTipCap with EIP-1559 support). This has not been
+// checked against the go-ethereum version this repo's go.mod actually
+// vendors — there is no go.mod in this tree to check it against. If that
+// version predates these fields, this package fails to build and
+// TransactAuth needs to drop back to a GasPrice-only bind.TransactOpts
+// until go-ethereum is bumped.
+type TransactAuth struct {
+	base *bind.TransactOpts
+
+	// EIP-1559 fee fields. GasFeeCap/GasTipCap take precedence over
+	// GasPrice when set, matching bind.TransactOpts semantics.
+	GasPrice  *big.Int
+	GasFeeCap *big.Int
+	GasTipCap *big.Int
+
+	// NoSend causes transactions built through this TransactAuth to be
+	// signed but not broadcast, so the caller can submit them through an
+	// external relay (e.g. a Flashbots-style private relay) instead of the
+	// node's own mempool.
+	NoSend bool
+}
+
+// NewTransactAuth wraps base, which is never mutated; every Create call
+// returns an independent copy.
+func NewTransactAuth(base *bind.TransactOpts) *TransactAuth {
+	return &TransactAuth{base: base}
+}
+
+// Create clones the base TransactOpts for a single call, attaching ctx and
+// this TransactAuth's gas and NoSend settings. The returned TransactOpts is
+// safe to use without synchronization, since it is not shared with any
+// other call site.
+func (t *TransactAuth) Create(ctx context.Context) *bind.TransactOpts {
+	opts := *t.base
+	opts.Context = ctx
+	opts.NoSend = t.NoSend
+
+	if t.GasFeeCap != nil || t.GasTipCap != nil {
+		opts.GasFeeCap = t.GasFeeCap
+		opts.GasTipCap = t.GasTipCap
+		opts.GasPrice = nil
+	} else if t.GasPrice != nil {
+		opts.GasPrice = t.GasPrice
+	}
+
+	return &opts
+}
@@ -0,0 +1,82 @@
+/*
+ * Copyright 2020, Offchain Labs, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ethbridge
+
+import (
+	"context"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+)
+
+func TestTransactAuthCreateSetsContextAndLeavesBaseUntouched(t *testing.T) {
+	base := &bind.TransactOpts{}
+	auth := NewTransactAuth(base)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	opts := auth.Create(ctx)
+	if opts.Context != ctx {
+		t.Fatalf("expected Create to attach the given context")
+	}
+	if base.Context != nil {
+		t.Fatalf("Create must not mutate the shared base TransactOpts")
+	}
+	if opts == base {
+		t.Fatalf("Create must return an independent copy, not the shared base")
+	}
+}
+
+func TestTransactAuthCreateGasPricePrecedence(t *testing.T) {
+	auth := NewTransactAuth(&bind.TransactOpts{})
+	auth.GasPrice = big.NewInt(5)
+
+	opts := auth.Create(context.Background())
+	if opts.GasPrice.Cmp(big.NewInt(5)) != 0 {
+		t.Fatalf("expected GasPrice to be carried onto the created TransactOpts")
+	}
+	if opts.GasFeeCap != nil || opts.GasTipCap != nil {
+		t.Fatalf("expected EIP-1559 fields to stay unset when only GasPrice is configured")
+	}
+}
+
+func TestTransactAuthCreateEIP1559OverridesGasPrice(t *testing.T) {
+	auth := NewTransactAuth(&bind.TransactOpts{})
+	auth.GasPrice = big.NewInt(5)
+	auth.GasFeeCap = big.NewInt(100)
+	auth.GasTipCap = big.NewInt(2)
+
+	opts := auth.Create(context.Background())
+	if opts.GasPrice != nil {
+		t.Fatalf("expected GasFeeCap/GasTipCap to take precedence over GasPrice")
+	}
+	if opts.GasFeeCap.Cmp(big.NewInt(100)) != 0 || opts.GasTipCap.Cmp(big.NewInt(2)) != 0 {
+		t.Fatalf("expected GasFeeCap/GasTipCap to be carried onto the created TransactOpts")
+	}
+}
+
+func TestTransactAuthCreateNoSend(t *testing.T) {
+	auth := NewTransactAuth(&bind.TransactOpts{})
+	auth.NoSend = true
+
+	opts := auth.Create(context.Background())
+	if !opts.NoSend {
+		t.Fatalf("expected NoSend to be carried onto the created TransactOpts")
+	}
+}